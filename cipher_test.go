@@ -0,0 +1,101 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func allCiphers() map[string]Cipher {
+	return map[string]Cipher{
+		"nfsc-rc4":     nfscRC4Cipher{},
+		"nfsc-rc4-inv": nfscRC4Cipher{invert: true},
+		"rc4":          plainRC4Cipher{},
+		"null":         nullCipher{},
+	}
+}
+
+func TestCiphersRegistered(t *testing.T) {
+	for name := range allCiphers() {
+		if _, ok := GetCipher(name); !ok {
+			t.Errorf("GetCipher(%q) not registered", name)
+		}
+	}
+}
+
+// TestCipherRoundTrips checks that crypting a message and then crypting the
+// result again with a freshly-initialized state of the same key recovers the
+// original plaintext, which every stream cipher backend must satisfy.
+func TestCipherRoundTrips(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	plain := []byte("the quick brown fox jumps over the lazy dog")
+
+	for name, c := range allCiphers() {
+		t.Run(name, func(t *testing.T) {
+			state := c.Init(key)
+			ct := make([]byte, len(plain))
+			c.XORKeyStream(state, ct, plain)
+
+			if name != "null" && bytes.Equal(ct, plain) {
+				t.Fatalf("ciphertext equals plaintext, cipher did nothing")
+			}
+
+			state2 := c.Init(key)
+			pt := make([]byte, len(ct))
+			c.XORKeyStream(state2, pt, ct)
+
+			if !bytes.Equal(pt, plain) {
+				t.Fatalf("round trip = %q, want %q", pt, plain)
+			}
+		})
+	}
+}
+
+// TestCipherCloneIsIndependent checks that advancing a clone doesn't affect
+// the state it was cloned from, which SeqTracker's checkpointing relies on.
+func TestCipherCloneIsIndependent(t *testing.T) {
+	key := []byte("0123456789abcdef")
+
+	for name, c := range allCiphers() {
+		t.Run(name, func(t *testing.T) {
+			state := c.Init(key)
+			clone := c.Clone(state)
+
+			c.Advance(clone, 32)
+
+			want := make([]byte, 8)
+			got := make([]byte, 8)
+			c.XORKeyStream(c.Init(key), want, make([]byte, 8))
+			c.XORKeyStream(state, got, make([]byte, 8))
+			if !bytes.Equal(want, got) {
+				t.Fatalf("advancing a clone mutated the original state")
+			}
+		})
+	}
+}
+
+func TestCipherAdvanceMatchesXORKeyStream(t *testing.T) {
+	for name, c := range allCiphers() {
+		t.Run(name, func(t *testing.T) {
+			key := []byte("0123456789abcdef")
+
+			advanced := c.Init(key)
+			c.Advance(advanced, 5)
+			tail := make([]byte, 3)
+			c.XORKeyStream(advanced, tail, make([]byte, 3))
+
+			direct := c.Init(key)
+			skip := make([]byte, 5)
+			c.XORKeyStream(direct, skip, make([]byte, 5))
+			want := make([]byte, 3)
+			c.XORKeyStream(direct, want, make([]byte, 3))
+
+			if !bytes.Equal(tail, want) {
+				t.Fatalf("Advance(5) then 3 bytes = %x, want %x (XORKeyStream 5 then 3)", tail, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// frameHeaderLen is the size of an NFS-C message frame header: a 1-byte
+// opcode followed by a 2-byte big-endian body length.
+const frameHeaderLen = 3
+
+// maxBufferedFrame bounds how large a flow's reassembly buffer may grow
+// while waiting for a frame to complete. A legitimate frame is at most
+// frameHeaderLen + 65535 bytes, the largest body a 16-bit length can
+// encode. Feed consumes every complete frame before it checks this bound,
+// so what it carries over is always shorter than one such frame and the
+// check does not fire with this framing; if the bound were exceeded, the
+// buffer would be dropped and reassembly would restart from the next
+// payload fed in.
+const maxBufferedFrame = 4 * (frameHeaderLen + 65535)
+
+// Message is one dissected NFS-C protocol message, written as a single line
+// of the sibling .jsonl file produced by -dissect.
+type Message struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Direction string                 `json:"direction"`
+	Opcode    byte                   `json:"opcode"`
+	Body      string                 `json:"body"`
+	Decoded   map[string]interface{} `json:"decoded,omitempty"`
+}
+
+// OpcodeDecoder turns a message body into named fields for opcodes whose
+// layout is known; unrecognized opcodes are still recorded with just their
+// raw hex body.
+type OpcodeDecoder func(body []byte) map[string]interface{}
+
+var opcodeDecoders = map[byte]OpcodeDecoder{}
+
+// RegisterOpcodeDecoder adds field decoding for a known NFS-C opcode.
+func RegisterOpcodeDecoder(opcode byte, decoder OpcodeDecoder) {
+	opcodeDecoders[opcode] = decoder
+}
+
+func init() {
+	RegisterOpcodeDecoder(0x00, decodeHeartbeat)
+}
+
+// decodeHeartbeat decodes opcode 0x00, the keepalive an NFS-C client and
+// server exchange periodically to hold a match open. Its body is a single
+// big-endian uint32 tick counter.
+func decodeHeartbeat(body []byte) map[string]interface{} {
+	if len(body) < 4 {
+		return nil
+	}
+	return map[string]interface{}{
+		"tick": binary.BigEndian.Uint32(body[:4]),
+	}
+}
+
+// Dissector reassembles decrypted UDP payloads into NFS-C message frames
+// per flow and writes one JSON record per message to a sibling .jsonl file,
+// turning the tool from a pcap rewriter into a protocol analyzer.
+type Dissector struct {
+	f       *os.File
+	enc     *json.Encoder
+	buffers map[flowKey][]byte
+}
+
+// NewDissector creates (or truncates) path and returns a Dissector that
+// writes JSON lines to it as Feed reassembles complete messages.
+func NewDissector(path string) (*Dissector, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Dissector{
+		f:       f,
+		enc:     json.NewEncoder(f),
+		buffers: make(map[flowKey][]byte),
+	}, nil
+}
+
+func (d *Dissector) Close() error {
+	return d.f.Close()
+}
+
+// Feed appends a decrypted UDP payload to flow's reassembly buffer and
+// emits every complete NFS-C message frame (opcode + 2-byte length + body)
+// it now contains, carrying over any trailing partial frame to the next
+// call.
+func (d *Dissector) Feed(flow flowKey, direction string, ts time.Time, payload []byte) {
+	buf := append(d.buffers[flow], payload...)
+
+	for len(buf) >= frameHeaderLen {
+		opcode := buf[0]
+		bodyLen := int(binary.BigEndian.Uint16(buf[1:3]))
+		if len(buf) < frameHeaderLen+bodyLen {
+			break
+		}
+		body := buf[frameHeaderLen : frameHeaderLen+bodyLen]
+
+		msg := Message{
+			Timestamp: ts,
+			Direction: direction,
+			Opcode:    opcode,
+			Body:      hex.EncodeToString(body),
+		}
+		if decode, ok := opcodeDecoders[opcode]; ok {
+			msg.Decoded = decode(body)
+		}
+		if err := d.enc.Encode(msg); err != nil {
+			warn("failed to write dissected message: %v\n", err)
+		}
+
+		buf = buf[frameHeaderLen+bodyLen:]
+	}
+
+	if len(buf) > maxBufferedFrame {
+		warn("dissector: flow buffer exceeded %d bytes without completing a frame, dropping and resyncing\n", maxBufferedFrame)
+		buf = nil
+	}
+
+	d.buffers[flow] = buf
+}
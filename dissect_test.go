@@ -0,0 +1,134 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func newTestDissector(t *testing.T) (*Dissector, string) {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "dissect-*.jsonl")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	path := f.Name()
+	f.Close()
+
+	d, err := NewDissector(path)
+	if err != nil {
+		t.Fatalf("NewDissector: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d, path
+}
+
+func testFlow() flowKey {
+	return newFlowKey(gopacket.NewFlow(layers.EndpointIPv4, []byte{1, 2, 3, 4}, []byte{5, 6, 7, 8}), 7777)
+}
+
+func frame(opcode byte, body []byte) []byte {
+	buf := make([]byte, frameHeaderLen+len(body))
+	buf[0] = opcode
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(body)))
+	copy(buf[frameHeaderLen:], body)
+	return buf
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestDissectorFeedSingleFrame(t *testing.T) {
+	d, path := newTestDissector(t)
+	flow := testFlow()
+
+	d.Feed(flow, "send", time.Unix(0, 0), frame(0x00, []byte{0, 0, 0, 42}))
+
+	if n := countLines(t, path); n != 1 {
+		t.Fatalf("wrote %d lines, want 1", n)
+	}
+	if len(d.buffers[flow]) != 0 {
+		t.Fatalf("leftover buffer = %d bytes, want 0", len(d.buffers[flow]))
+	}
+}
+
+func TestDissectorFeedMultipleFramesInOnePayload(t *testing.T) {
+	d, path := newTestDissector(t)
+	flow := testFlow()
+
+	payload := append(frame(0x01, []byte("a")), frame(0x02, []byte("bb"))...)
+	d.Feed(flow, "recv", time.Unix(0, 0), payload)
+
+	if n := countLines(t, path); n != 2 {
+		t.Fatalf("wrote %d lines, want 2", n)
+	}
+}
+
+func TestDissectorFeedPartialFrameAcrossCalls(t *testing.T) {
+	d, path := newTestDissector(t)
+	flow := testFlow()
+
+	full := frame(0x03, []byte("hello"))
+	d.Feed(flow, "send", time.Unix(0, 0), full[:2])
+	if n := countLines(t, path); n != 0 {
+		t.Fatalf("wrote %d lines after partial header, want 0", n)
+	}
+
+	d.Feed(flow, "send", time.Unix(0, 0), full[2:])
+	if n := countLines(t, path); n != 1 {
+		t.Fatalf("wrote %d lines after completing frame, want 1", n)
+	}
+}
+
+func TestDissectorFeedLargestFrameLeavesNoBuffer(t *testing.T) {
+	d, _ := newTestDissector(t)
+	flow := testFlow()
+
+	// A header claiming the largest body a 16-bit length allows, followed by
+	// maxBufferedFrame zero bytes: the large frame completes and the rest
+	// parses as empty opcode-0 frames, so nothing is left buffered.
+	header := make([]byte, frameHeaderLen)
+	header[0] = 0x7f
+	binary.BigEndian.PutUint16(header[1:3], 65535)
+	d.Feed(flow, "send", time.Unix(0, 0), header)
+	d.Feed(flow, "send", time.Unix(0, 0), make([]byte, maxBufferedFrame))
+
+	if len(d.buffers[flow]) != 0 {
+		t.Fatalf("buffer len = %d after feeding, want 0", len(d.buffers[flow]))
+	}
+}
+
+func TestDecodeHeartbeat(t *testing.T) {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, 99)
+
+	decoded := decodeHeartbeat(body)
+	if decoded["tick"] != uint32(99) {
+		t.Fatalf("decoded tick = %v, want 99", decoded["tick"])
+	}
+
+	if decodeHeartbeat(nil) != nil {
+		t.Fatalf("expected nil decode for short body")
+	}
+}
@@ -5,14 +5,21 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/pcapgo"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 type Keystream struct {
@@ -63,87 +70,264 @@ func fatal(str string, args ...interface{}) {
 	os.Exit(1)
 }
 
-func main() {
-	if len(os.Args) < 5 {
-		fatal("Usage: %s in.pcapng out.pcapng ekey port\n", os.Args[0])
+func warn(str string, args ...interface{}) {
+	_, _ = fmt.Fprintf(os.Stderr, "warning: "+str, args...)
+}
+
+// Session holds the send/recv keystreams and destination port for a single
+// decrypted NFS match, and knows how to turn one captured packet into a
+// decrypted one on the given pcapng sink.
+type Session struct {
+	cipher               Cipher
+	sendState, recvState CipherState
+	sendTracker          *SeqTracker
+	recvTracker          *SeqTracker
+	dstPort              layers.UDPPort
+	wr                   PcapSink
+	dissector            *Dissector
+	stdout               bool
+}
+
+func NewSession(keyBytes []byte, dstPort int, wr PcapSink, cipher Cipher, dissector *Dissector, stdout bool) *Session {
+	return &Session{
+		cipher:      cipher,
+		sendState:   cipher.Init(keyBytes),
+		recvState:   cipher.Init(keyBytes),
+		sendTracker: &SeqTracker{},
+		recvTracker: &SeqTracker{},
+		dstPort:     layers.UDPPort(dstPort),
+		wr:          wr,
+		dissector:   dissector,
+		stdout:      stdout,
 	}
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		fatal("Failed to open input file: %v\n", err)
+}
+
+// HandlePacket decrypts pkt in place if it carries UDP traffic on the
+// session's port and writes the result to the session's pcapng sink. It is
+// the single code path shared by the offline pcapng reader and live capture.
+func (s *Session) HandlePacket(pkt gopacket.Packet, srcCi gopacket.CaptureInfo) {
+	udpLayer := pkt.Layer(layers.LayerTypeUDP)
+	if udpLayer == nil {
+		return
 	}
-	rd, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
-	if err != nil {
-		fatal("Failed to create pcap reader: %v\n", err)
+	udp := udpLayer.(*layers.UDP)
+	if udp.DstPort != s.dstPort && udp.SrcPort != s.dstPort {
+		return
+	}
+	if len(udp.Payload) < 2 {
+		warn("short udp payload (%d bytes) on port %d, skipping\n", len(udp.Payload), s.dstPort)
+		return
+	}
+	if !s.stdout {
+		fmt.Printf("udp %d -> %d\n", udp.SrcPort, udp.DstPort)
 	}
 
-	fout, err := os.Create(os.Args[2])
-	if err != nil {
-		fatal("Failed to create output file: %v\n", err)
+	var state CipherState
+	var tracker *SeqTracker
+	if udp.DstPort == s.dstPort {
+		state, tracker = s.sendState, s.sendTracker
+	} else {
+		state, tracker = s.recvState, s.recvTracker
 	}
-	wr, err := pcapgo.NewNgWriter(fout, layers.LinkTypeEthernet)
-	if err != nil {
-		fatal("Failed to create pcap writer: %v\n", err)
+
+	seq := binary.BigEndian.Uint16(udp.Payload[:2])
+	state, warning := tracker.Resync(s.cipher, state, seq)
+	if warning != "" {
+		warn("keystream resync: %s (udp %d -> %d)\n", warning, udp.SrcPort, udp.DstPort)
+	}
+	payload := udp.Payload[2:]
+	s.cipher.XORKeyStream(state, payload, payload)
+	tracker.Advanced(len(payload))
+
+	if udp.DstPort == s.dstPort {
+		s.sendState = state
+	} else {
+		s.recvState = state
+	}
+
+	if s.stdout {
+		fmt.Println(hex.EncodeToString(payload))
+	}
+
+	if s.dissector != nil {
+		direction := "recv"
+		if udp.DstPort == s.dstPort {
+			direction = "send"
+		}
+		if netLayer := pkt.NetworkLayer(); netLayer != nil {
+			flow := newFlowKey(netLayer.NetworkFlow(), s.dstPort)
+			s.dissector.Feed(flow, direction, srcCi.Timestamp, payload)
+		}
 	}
-	defer wr.Flush()
-	defer fout.Close()
 
-	ekey := os.Args[3]
+	pktLayers := make([]gopacket.SerializableLayer, len(pkt.Layers()))
+	for i := 0; i < len(pktLayers)-1; i++ {
+		pktLayers[i] = pkt.Layers()[i].(gopacket.SerializableLayer)
+	}
+	pktLayers[len(pktLayers)-1] = gopacket.Payload(payload)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, pktLayers...); err != nil {
+		panic(err)
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     srcCi.Timestamp,
+		CaptureLength: len(buf.Bytes()),
+		Length:        len(buf.Bytes()),
+	}
+	if err := s.wr.WritePacketWithComment(ci, buf.Bytes(), warning); err != nil {
+		panic(err)
+	}
+}
+
+// Dispatch makes Session satisfy PacketHandler so it can be driven by the
+// same runOffline/runLive loops as a SessionRegistry; data is unused since a
+// single-session run has nothing to pass through unmodified.
+func (s *Session) Dispatch(data []byte, pkt gopacket.Packet, ci gopacket.CaptureInfo) {
+	s.HandlePacket(pkt, ci)
+}
+
+// PacketHandler is implemented by both Session and SessionRegistry so
+// runOffline/runLive can drive either a single decrypt target or a whole
+// config of concurrent ones.
+type PacketHandler interface {
+	Dispatch(data []byte, pkt gopacket.Packet, ci gopacket.CaptureInfo)
+}
+
+func parseKeyBytes(ekey, portArg string) ([]byte, string) {
 	keyBytes := []byte(ekey)[:16]
-	if strings.HasPrefix(os.Args[4], "int:") {
-		os.Args[4] = strings.TrimPrefix(os.Args[4], "int:")
+	if strings.HasPrefix(portArg, "int:") {
+		portArg = strings.TrimPrefix(portArg, "int:")
 		for i := 0; i < 16; i++ {
 			keyBytes[i] = ^keyBytes[i]
 		}
 	}
-	dstPort, err := strconv.Atoi(os.Args[4])
+	return keyBytes, portArg
+}
+
+func main() {
+	iface := flag.String("iface", "", "capture live from this network interface instead of reading -in")
+	bpf := flag.String("bpf", "", "BPF filter applied to the live capture (ignored for offline pcapng input)")
+	snaplen := flag.Int("snaplen", 65536, "snapshot length for live capture")
+	sessions := flag.String("sessions", "", "YAML/JSON file listing {ekey, port, invert} entries to decrypt concurrently, in place of the positional ekey/port")
+	cipherName := flag.String("cipher", "nfsc-rc4", "cipher backend to use: nfsc-rc4, nfsc-rc4-inv, rc4, or null")
+	dissect := flag.Bool("dissect", false, "write a sibling out.jsonl with one record per decrypted NFS-C message")
+	stdout := flag.Bool("stdout", false, "also print each decrypted payload as hex to stdout, for tailing a live capture")
+	rotateBytes := flag.Int64("rotate-bytes", 0, "rotate to a new numbered out.N.pcapng every N bytes of packet data (0 disables rotation)")
+	flag.Parse()
+
+	cipher, ok := GetCipher(*cipherName)
+	if !ok {
+		fatal("Unknown cipher %q\n", *cipherName)
+	}
+
+	args := flag.Args()
+	minArgs := 4
+	if *sessions != "" {
+		minArgs = 2
+	}
+	if len(args) < minArgs {
+		fatal("Usage: %s [-iface eth0 [-bpf ...] [-snaplen N]] in.pcapng out.pcapng (ekey port | -sessions sessions.yaml)\n", os.Args[0])
+	}
+
+	var wr PcapSink
+	var err error
+	if *rotateBytes > 0 {
+		wr, err = NewRotatingSink(args[1], *rotateBytes)
+	} else {
+		wr, err = newNgSink(args[1])
+	}
 	if err != nil {
-		fatal("Failed to parse destination port: %v\n", err)
+		fatal("Failed to create output file: %v\n", err)
+	}
+	defer wr.Close()
+
+	var dissector *Dissector
+	if *dissect {
+		dissectPath := strings.TrimSuffix(args[1], filepath.Ext(args[1])) + ".jsonl"
+		dissector, err = NewDissector(dissectPath)
+		if err != nil {
+			fatal("Failed to create dissection output %s: %v\n", dissectPath, err)
+		}
+		defer dissector.Close()
+	}
+
+	var handler PacketHandler
+	if *sessions != "" {
+		configs, err := LoadSessionConfigs(*sessions)
+		if err != nil {
+			fatal("Failed to load session config %s: %v\n", *sessions, err)
+		}
+		handler = NewSessionRegistry(configs, wr, cipher, dissector, *stdout)
+	} else {
+		keyBytes, portArg := parseKeyBytes(args[2], args[3])
+		dstPort, err := strconv.Atoi(portArg)
+		if err != nil {
+			fatal("Failed to parse destination port: %v\n", err)
+		}
+		handler = NewSession(keyBytes, dstPort, wr, cipher, dissector, *stdout)
+	}
+
+	if *iface != "" {
+		runLive(*iface, *bpf, *snaplen, handler, wr)
+		return
+	}
+	runOffline(args[0], handler)
+}
+
+// runOffline replays a previously captured pcapng file through handler.
+func runOffline(path string, handler PacketHandler) {
+	f, err := os.Open(path)
+	if err != nil {
+		fatal("Failed to open input file: %v\n", err)
+	}
+	defer f.Close()
+	rd, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		fatal("Failed to create pcap reader: %v\n", err)
 	}
-	sendKS := InitKeystream(keyBytes, 1)
-	recvKS := InitKeystream(keyBytes, 1)
 
 	for {
-		data, srcCi, err := rd.ReadPacketData()
+		data, ci, err := rd.ReadPacketData()
 		if err != nil {
 			return
 		}
 		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
-		if udpLayer := pkt.Layer(layers.LayerTypeUDP); udpLayer != nil {
-			udp := udpLayer.(*layers.UDP)
-			if udp.DstPort != layers.UDPPort(dstPort) && udp.SrcPort != layers.UDPPort(dstPort) {
-				continue
-			}
-			fmt.Printf("udp %d -> %d\n", udp.SrcPort, udp.DstPort)
+		handler.Dispatch(data, pkt, ci)
+	}
+}
 
-			var keystream *Keystream
-			if udp.DstPort == layers.UDPPort(dstPort) {
-				keystream = sendKS
-			} else {
-				keystream = recvKS
-			}
+// runLive attaches to iface with pcap.OpenLive and decrypts matching
+// traffic as it arrives, writing decrypted packets to handler's sink as it
+// goes so a concurrent `tail -f` on the output file sees them in real time.
+// It returns on SIGINT/SIGTERM instead of blocking forever, so main's
+// deferred sink/dissector Close calls still run and flush what's buffered.
+func runLive(iface, bpf string, snaplen int, handler PacketHandler, wr PcapSink) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-			ksPos := byte(binary.BigEndian.Uint16(udp.Payload[:2]) * 4)
-			if ksPos > keystream.A {
-				keystream.Scramble(int(ksPos - keystream.A))
-			}
-			payload := udp.Payload[2:]
-			keystream.Crypt(payload)
+	handle, err := pcap.OpenLive(iface, int32(snaplen), true, pcap.BlockForever)
+	if err != nil {
+		fatal("Failed to open %s for live capture: %v\n", iface, err)
+	}
+	defer handle.Close()
 
-			layers := make([]gopacket.SerializableLayer, len(pkt.Layers()))
-			for i := 0; i < len(layers)-1; i++ {
-				layers[i] = pkt.Layers()[i].(gopacket.SerializableLayer)
-			}
-			layers[len(layers)-1] = gopacket.Payload(payload)
-			buf := gopacket.NewSerializeBuffer()
-			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, layers...); err != nil {
-				panic(err)
-			}
-			ci := gopacket.CaptureInfo{
-				Timestamp:     srcCi.Timestamp,
-				CaptureLength: len(buf.Bytes()),
-				Length:        len(buf.Bytes()),
+	if bpf != "" {
+		if err := handle.SetBPFFilter(bpf); err != nil {
+			fatal("Failed to apply BPF filter %q: %v\n", bpf, err)
+		}
+	}
+
+	packets := gopacket.NewPacketSource(handle, handle.LinkType()).Packets()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pkt, ok := <-packets:
+			if !ok {
+				return
 			}
-			if err := wr.WritePacket(ci, buf.Bytes()); err != nil {
+			handler.Dispatch(pkt.Data(), pkt, pkt.Metadata().CaptureInfo)
+			if err := wr.Flush(); err != nil {
 				panic(err)
 			}
 		}
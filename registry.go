@@ -0,0 +1,155 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+)
+
+// SessionConfig describes one NFS match to decrypt, as read from a
+// -sessions file. Port is the game server's listening port; a session is
+// created the first time traffic on that port is seen between a new
+// client/server pair.
+type SessionConfig struct {
+	EKey   string `yaml:"ekey" json:"ekey"`
+	Port   int    `yaml:"port" json:"port"`
+	Invert bool   `yaml:"invert" json:"invert"`
+	Cipher string `yaml:"cipher" json:"cipher"`
+}
+
+// LoadSessionConfigs reads a list of SessionConfig from a YAML or JSON file,
+// picked by file extension.
+func LoadSessionConfigs(path string) ([]SessionConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []SessionConfig
+	if strings.HasSuffix(path, ".json") {
+		err = json.Unmarshal(data, &configs)
+	} else {
+		err = yaml.Unmarshal(data, &configs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return configs, nil
+}
+
+// flowKey identifies one UDP conversation regardless of which side sent a
+// given packet, so both directions of a match land on the same Session.
+type flowKey struct {
+	endpoints gopacket.Flow
+	port      layers.UDPPort
+}
+
+func newFlowKey(netFlow gopacket.Flow, port layers.UDPPort) flowKey {
+	if netFlow.Src().LessThan(netFlow.Dst()) {
+		netFlow = netFlow.Reverse()
+	}
+	return flowKey{endpoints: netFlow, port: port}
+}
+
+// SessionRegistry dispatches packets from a pcapng capture containing
+// several concurrent NFS matches to the right Session, creating sessions on
+// demand from a list of configured ekey/port/invert entries. Traffic on a
+// port with no matching config is copied through unmodified.
+type SessionRegistry struct {
+	configsByPort map[int]SessionConfig
+	sessions      map[flowKey]*Session
+	wr            PcapSink
+	defaultCipher Cipher
+	dissector     *Dissector
+	stdout        bool
+}
+
+// NewSessionRegistry builds a registry from configs, using defaultCipher for
+// any entry that doesn't name its own -cipher in the config file. dissector
+// may be nil, in which case no .jsonl dissection is written.
+func NewSessionRegistry(configs []SessionConfig, wr PcapSink, defaultCipher Cipher, dissector *Dissector, stdout bool) *SessionRegistry {
+	byPort := make(map[int]SessionConfig, len(configs))
+	for _, c := range configs {
+		byPort[c.Port] = c
+	}
+	return &SessionRegistry{
+		configsByPort: byPort,
+		sessions:      make(map[flowKey]*Session),
+		wr:            wr,
+		defaultCipher: defaultCipher,
+		dissector:     dissector,
+		stdout:        stdout,
+	}
+}
+
+// Dispatch routes a captured packet to its Session, creating one on first
+// sight of a configured port, or copies it through verbatim when it is UDP
+// traffic on an unconfigured port (or not UDP at all), so the output pcapng
+// is a faithful superset of the input.
+func (r *SessionRegistry) Dispatch(data []byte, pkt gopacket.Packet, ci gopacket.CaptureInfo) {
+	udpLayer := pkt.Layer(layers.LayerTypeUDP)
+	netLayer := pkt.NetworkLayer()
+	if udpLayer == nil || netLayer == nil {
+		r.passthrough(data, ci)
+		return
+	}
+	udp := udpLayer.(*layers.UDP)
+
+	cfg, ok := r.configsByPort[int(udp.SrcPort)]
+	if !ok {
+		cfg, ok = r.configsByPort[int(udp.DstPort)]
+	}
+	if !ok {
+		r.passthrough(data, ci)
+		return
+	}
+
+	key := newFlowKey(netLayer.NetworkFlow(), layers.UDPPort(cfg.Port))
+	session, ok := r.sessions[key]
+	if !ok {
+		if len(cfg.EKey) < 16 {
+			warn("session on port %d has ekey shorter than 16 bytes (%d), passing its packets through unmodified\n", cfg.Port, len(cfg.EKey))
+			r.sessions[key] = nil
+		} else {
+			keyBytes := []byte(cfg.EKey)[:16]
+			if cfg.Invert {
+				if cfg.Cipher == "nfsc-rc4-inv" {
+					warn("session on port %d sets both invert: true and cipher: nfsc-rc4-inv, which cancel each other out; ignoring invert\n", cfg.Port)
+				} else {
+					for i := range keyBytes {
+						keyBytes[i] = ^keyBytes[i]
+					}
+				}
+			}
+			cipher := r.defaultCipher
+			if cfg.Cipher != "" {
+				if c, ok := GetCipher(cfg.Cipher); ok {
+					cipher = c
+				} else {
+					warn("session on port %d names unknown cipher %q, falling back to default\n", cfg.Port, cfg.Cipher)
+				}
+			}
+			session = NewSession(keyBytes, cfg.Port, r.wr, cipher, r.dissector, r.stdout)
+			r.sessions[key] = session
+		}
+	}
+	if session == nil || len(udp.Payload) < 2 {
+		r.passthrough(data, ci)
+		return
+	}
+	session.HandlePacket(pkt, ci)
+}
+
+func (r *SessionRegistry) passthrough(data []byte, ci gopacket.CaptureInfo) {
+	if err := r.wr.WritePacket(ci, data); err != nil {
+		panic(err)
+	}
+}
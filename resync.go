@@ -0,0 +1,111 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import "fmt"
+
+const (
+	// checkpointInterval is how often (in packets) a SeqTracker snapshots
+	// cipher state, so a backwards jump never has to rewind further than
+	// this.
+	checkpointInterval = 16
+	// checkpointCapacity bounds the ring buffer of snapshots kept per
+	// SeqTracker; old checkpoints are evicted once it's full.
+	checkpointCapacity = 64
+	// maxForwardScramble caps how far a single packet is allowed to
+	// advance a cipher's state. A legitimate NFS-C stream never skips
+	// this many positions in one packet; anything bigger is almost
+	// certainly a corrupt or spoofed header, not a dropped packet.
+	maxForwardScramble = 1024
+)
+
+// ksCheckpoint is a snapshot of one direction's cipher state and keystream
+// position at a known sequence number, so SeqTracker can rewind to it
+// instead of re-deriving the keystream from scratch.
+type ksCheckpoint struct {
+	seq   uint16
+	pos   uint32
+	state CipherState
+}
+
+// SeqTracker makes keystream advancement robust to reordered or lost UDP
+// packets for one direction of one Session. It tracks the keystream
+// position itself (pos) rather than reading it back out of the cipher, so
+// it works the same for every Cipher backend. pos is wider than the 16-bit
+// sequence number it's derived from so a large forward jump is actually
+// representable instead of wrapping, letting maxForwardScramble cap it.
+type SeqTracker struct {
+	lastSeq     uint16
+	pos         uint32
+	checkpoints []ksCheckpoint
+}
+
+// Resync advances state to the position implied by seq, the 16-bit sequence
+// number read from an NFS-C packet header, using cipher to do the actual
+// advancing. On a backwards jump it first restores the nearest checkpoint,
+// returning the (possibly different) CipherState the caller should keep
+// using. It returns a non-empty warning describing any anomaly, or "" when
+// seq simply continued on from the last packet. seq is compared to lastSeq
+// using serial number arithmetic (RFC 1982) so a wrap from 65535 back to 0
+// on a long-running capture reads as a forward continuation, not a
+// backwards jump.
+func (t *SeqTracker) Resync(cipher Cipher, state CipherState, seq uint16) (CipherState, string) {
+	ksPos := uint32(seq) * 4
+	warning := ""
+
+	if int16(seq-t.lastSeq) < 0 {
+		if cp, ok := t.nearestCheckpoint(seq); ok {
+			state = cipher.Clone(cp.state)
+			t.pos = cp.pos
+			warning = fmt.Sprintf("seq %d < %d, restored checkpoint at %d", seq, t.lastSeq, cp.seq)
+		} else {
+			warning = fmt.Sprintf("seq %d < %d, no checkpoint old enough, continuing without rewind", seq, t.lastSeq)
+		}
+	}
+
+	if ksPos > t.pos {
+		delta := int(ksPos - t.pos)
+		if delta > maxForwardScramble {
+			if warning == "" {
+				warning = fmt.Sprintf("large forward jump of %d, capping scramble at %d", delta, maxForwardScramble)
+			}
+			delta = maxForwardScramble
+		}
+		cipher.Advance(state, delta)
+		t.pos += uint32(delta)
+	}
+
+	t.lastSeq = seq
+	t.maybeCheckpoint(cipher, state, seq)
+	return state, warning
+}
+
+// Advanced reports len(payload) bytes were just crypted, keeping pos in
+// sync with the cipher's own internal advancement.
+func (t *SeqTracker) Advanced(n int) {
+	t.pos += uint32(n)
+}
+
+func (t *SeqTracker) maybeCheckpoint(cipher Cipher, state CipherState, seq uint16) {
+	if len(t.checkpoints) > 0 && int(int16(seq-t.checkpoints[len(t.checkpoints)-1].seq)) < checkpointInterval {
+		return
+	}
+	if len(t.checkpoints) >= checkpointCapacity {
+		t.checkpoints = t.checkpoints[1:]
+	}
+	t.checkpoints = append(t.checkpoints, ksCheckpoint{seq: seq, pos: t.pos, state: cipher.Clone(state)})
+}
+
+func (t *SeqTracker) nearestCheckpoint(seq uint16) (ksCheckpoint, bool) {
+	var best ksCheckpoint
+	found := false
+	for _, cp := range t.checkpoints {
+		if cp.seq <= seq && (!found || cp.seq > best.seq) {
+			best = cp
+			found = true
+		}
+	}
+	return best, found
+}
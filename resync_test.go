@@ -0,0 +1,115 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import "testing"
+
+// fakeCipherState counts how far a fake cipher has advanced, so tests can
+// assert on SeqTracker's behavior without depending on a real Cipher's
+// internals.
+type fakeCipherState struct {
+	pos int
+}
+
+type fakeCipher struct{}
+
+func (fakeCipher) Init(key []byte) CipherState { return &fakeCipherState{} }
+
+func (fakeCipher) Advance(state CipherState, n int) {
+	state.(*fakeCipherState).pos += n
+}
+
+func (fakeCipher) XORKeyStream(state CipherState, dst, src []byte) {
+	copy(dst, src)
+	state.(*fakeCipherState).pos += len(src)
+}
+
+func (fakeCipher) Clone(state CipherState) CipherState {
+	clone := *state.(*fakeCipherState)
+	return &clone
+}
+
+func TestSeqTrackerForwardAdvance(t *testing.T) {
+	c := fakeCipher{}
+	tr := &SeqTracker{}
+	state := c.Init(nil)
+
+	state, warning := tr.Resync(c, state, 1)
+	if warning != "" {
+		t.Fatalf("unexpected warning on first packet: %q", warning)
+	}
+	if got := state.(*fakeCipherState).pos; got != 4 {
+		t.Fatalf("pos after seq 1 = %d, want 4", got)
+	}
+
+	state, warning = tr.Resync(c, state, 2)
+	if warning != "" {
+		t.Fatalf("unexpected warning advancing seq 1 -> 2: %q", warning)
+	}
+	if got := state.(*fakeCipherState).pos; got != 8 {
+		t.Fatalf("pos after seq 2 = %d, want 8", got)
+	}
+}
+
+func TestSeqTrackerCapsLargeForwardJump(t *testing.T) {
+	c := fakeCipher{}
+	tr := &SeqTracker{}
+	state := c.Init(nil)
+
+	// seq * 4 jumps pos far enough ahead that the delta exceeds
+	// maxForwardScramble, which must be capped rather than applied in full.
+	state, warning := tr.Resync(c, state, 1000)
+	if warning == "" {
+		t.Fatalf("expected a capped-forward-jump warning, got none")
+	}
+	if got := state.(*fakeCipherState).pos; got != maxForwardScramble {
+		t.Fatalf("pos after capped jump = %d, want %d", got, maxForwardScramble)
+	}
+}
+
+func TestSeqTrackerBackwardJumpRestoresCheckpoint(t *testing.T) {
+	c := fakeCipher{}
+	tr := &SeqTracker{}
+	state := c.Init(nil)
+
+	var seq uint16
+	for seq = 1; seq <= uint16(checkpointInterval)+1; seq++ {
+		state, _ = tr.Resync(c, state, seq)
+	}
+	lastPos := state.(*fakeCipherState).pos
+
+	// Jump back to a sequence number old enough that a checkpoint exists.
+	state, warning := tr.Resync(c, state, 1)
+	if warning == "" {
+		t.Fatalf("expected a warning on backward jump, got none")
+	}
+	if got := state.(*fakeCipherState).pos; got >= lastPos {
+		t.Fatalf("pos after backward jump = %d, want less than %d (pre-jump pos)", got, lastPos)
+	}
+}
+
+func TestSeqTrackerWrapIsNotABackwardJump(t *testing.T) {
+	c := fakeCipher{}
+	tr := &SeqTracker{}
+	state := c.Init(nil)
+
+	state, _ = tr.Resync(c, state, 65530)
+	_, warning := tr.Resync(c, state, 10)
+	if warning != "" {
+		t.Fatalf("seq wrap from 65530 to 10 produced warning %q, want none", warning)
+	}
+}
+
+func TestSeqTrackerBackwardJumpWithoutCheckpointWarns(t *testing.T) {
+	c := fakeCipher{}
+	tr := &SeqTracker{}
+	state := c.Init(nil)
+
+	state, _ = tr.Resync(c, state, 100)
+	state, warning := tr.Resync(c, state, 1)
+	if warning == "" {
+		t.Fatalf("expected a warning for an unrecoverable backward jump, got none")
+	}
+}
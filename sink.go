@@ -0,0 +1,204 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"os"
+)
+
+// PcapSink is where a Session/SessionRegistry writes decrypted packets.
+// ngSink is a single pcapng file; RotatingSink composes several of them so a
+// long-running live capture doesn't grow one file without bound.
+type PcapSink interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
+	// WritePacketWithComment is like WritePacket but attaches comment to the
+	// packet as a pcapng option, so tools like Wireshark show it alongside
+	// the packet. comment == "" is equivalent to WritePacket.
+	WritePacketWithComment(ci gopacket.CaptureInfo, data []byte, comment string) error
+	Flush() error
+	Close() error
+}
+
+// pcapng Enhanced Packet Block constants, per the pcapng spec
+// (https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html). These
+// mirror gopacket/pcapgo's unexported equivalents: NgWriter.WritePacket has
+// no way to attach per-packet options, so a packet carrying a comment is
+// written as a raw block instead, after flushing NgWriter's own buffer to
+// keep block ordering intact.
+const (
+	ngBlockTypeEnhancedPacket = 0x00000006
+	ngOptionCodeEndOfOptions  = 0
+	ngOptionCodeComment       = 1
+)
+
+// ngSink is a pcapng file plus the *os.File backing it, since pcapgo.NgWriter
+// only owns the bufio.Writer wrapped around that file and never closes it.
+type ngSink struct {
+	f  *os.File
+	wr *pcapgo.NgWriter
+}
+
+func newNgSink(path string) (*ngSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	wr, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ngSink{f: f, wr: wr}, nil
+}
+
+func (s *ngSink) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	return s.wr.WritePacket(ci, data)
+}
+
+func (s *ngSink) WritePacketWithComment(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	if comment == "" {
+		return s.wr.WritePacket(ci, data)
+	}
+	// s.wr buffers through a bufio.Writer; flush it first so the raw block
+	// written below lands after everything queued ahead of it.
+	if err := s.wr.Flush(); err != nil {
+		return err
+	}
+	return writeEPBWithComment(s.f, ci, data, comment)
+}
+
+// writeEPBWithComment writes one Enhanced Packet Block directly to f,
+// carrying data plus a single comment option, matching the block layout
+// NgWriter.WritePacket uses but with an options section appended.
+func writeEPBWithComment(f *os.File, ci gopacket.CaptureInfo, data []byte, comment string) error {
+	dataPad := (4 - len(data)%4) % 4
+	commentBytes := []byte(comment)
+	commentPad := (4 - len(commentBytes)%4) % 4
+	optsLen := 4 + len(commentBytes) + commentPad + 4 // comment TLV + end-of-options TLV
+	totalLen := 28 + len(data) + dataPad + optsLen + 4
+
+	buf := make([]byte, 0, totalLen)
+
+	var hdr [28]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], ngBlockTypeEnhancedPacket)
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(totalLen))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(ci.InterfaceIndex))
+	ts := ci.Timestamp.UnixNano()
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(ts))
+	binary.LittleEndian.PutUint32(hdr[20:24], uint32(ci.CaptureLength))
+	binary.LittleEndian.PutUint32(hdr[24:28], uint32(ci.Length))
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, data...)
+	buf = append(buf, make([]byte, dataPad)...)
+
+	var commentHdr [4]byte
+	binary.LittleEndian.PutUint16(commentHdr[0:2], ngOptionCodeComment)
+	binary.LittleEndian.PutUint16(commentHdr[2:4], uint16(len(commentBytes)))
+	buf = append(buf, commentHdr[:]...)
+	buf = append(buf, commentBytes...)
+	buf = append(buf, make([]byte, commentPad)...)
+	buf = append(buf, 0, 0, 0, 0) // end-of-options option: code 0, length 0
+
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(totalLen))
+	buf = append(buf, trailer[:]...)
+
+	_, err := f.Write(buf)
+	return err
+}
+
+func (s *ngSink) Flush() error {
+	return s.wr.Flush()
+}
+
+func (s *ngSink) Close() error {
+	if err := s.wr.Flush(); err != nil {
+		return err
+	}
+	return s.f.Close()
+}
+
+// RotatingSink writes to a sequence of ngSinks, starting a new file once the
+// current one has taken roughly maxBytes of packet data, so a live capture
+// left running for a long match doesn't produce one unbounded pcapng.
+// Rotation is suffix-numbered: base.pcapng, base.1.pcapng, base.2.pcapng, ...
+type RotatingSink struct {
+	base     string
+	ext      string
+	maxBytes int64
+
+	cur     *ngSink
+	written int64
+	index   int
+}
+
+// NewRotatingSink creates the first output file at path and rotates to a new
+// one every time maxBytes of packet data have been written to the current
+// file. maxBytes <= 0 disables rotation (equivalent to a plain ngSink).
+func NewRotatingSink(path string, maxBytes int64) (*RotatingSink, error) {
+	base, ext := splitExt(path)
+	r := &RotatingSink{base: base, ext: ext, maxBytes: maxBytes}
+	sink, err := newNgSink(path)
+	if err != nil {
+		return nil, err
+	}
+	r.cur = sink
+	return r, nil
+}
+
+func splitExt(path string) (base, ext string) {
+	for i := len(path) - 1; i >= 0 && path[i] != '/'; i-- {
+		if path[i] == '.' {
+			return path[:i], path[i:]
+		}
+	}
+	return path, ""
+}
+
+func (r *RotatingSink) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	return r.WritePacketWithComment(ci, data, "")
+}
+
+func (r *RotatingSink) WritePacketWithComment(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	if r.maxBytes > 0 && r.written > 0 && r.written+int64(len(data)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := r.cur.WritePacketWithComment(ci, data, comment); err != nil {
+		return err
+	}
+	r.written += int64(len(data))
+	return nil
+}
+
+func (r *RotatingSink) rotate() error {
+	if err := r.cur.Close(); err != nil {
+		return err
+	}
+	r.index++
+	path := fmt.Sprintf("%s.%d%s", r.base, r.index, r.ext)
+	sink, err := newNgSink(path)
+	if err != nil {
+		return err
+	}
+	r.cur = sink
+	r.written = 0
+	return nil
+}
+
+func (r *RotatingSink) Flush() error {
+	return r.cur.Flush()
+}
+
+func (r *RotatingSink) Close() error {
+	return r.cur.Close()
+}